@@ -0,0 +1,105 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFillStrategies(t *testing.T) {
+	tests := []struct {
+		name     string
+		strategy FillStrategy
+		in       [][]string
+		want     [][]string
+	}{
+		{
+			name:     "none leaves blanks",
+			strategy: noneFill{},
+			in:       [][]string{{"a", ""}, {"", "b"}},
+			want:     [][]string{{"a", ""}, {"", "b"}},
+		},
+		{
+			name:     "down inherits from the row above",
+			strategy: downFill{},
+			in:       [][]string{{"a", "1"}, {"", ""}, {"b", ""}},
+			want:     [][]string{{"a", "1"}, {"a", "1"}, {"b", "1"}},
+		},
+		{
+			name:     "down restricted to a column leaves the rest blank",
+			strategy: downFill{columnFilter: columnFilter{columns: map[int]bool{0: true}}},
+			in:       [][]string{{"a", "1"}, {"", ""}},
+			want:     [][]string{{"a", "1"}, {"a", ""}},
+		},
+		{
+			name:     "up inherits from the row below",
+			strategy: upFill{},
+			in:       [][]string{{"", "1"}, {"b", ""}, {"", "c"}},
+			want:     [][]string{{"b", "1"}, {"b", "c"}, {"", "c"}},
+		},
+		{
+			name:     "constant fills every blank",
+			strategy: constantFill{value: "N/A"},
+			in:       [][]string{{"a", ""}, {"", ""}},
+			want:     [][]string{{"a", "N/A"}, {"N/A", "N/A"}},
+		},
+		{
+			name:     "column-default fills only the listed columns",
+			strategy: columnDefaultFill{defaults: map[int]string{1: "0"}},
+			in:       [][]string{{"", ""}, {"x", ""}},
+			want:     [][]string{{"", "0"}, {"x", "0"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.strategy.Apply(tt.in)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewFillStrategy(t *testing.T) {
+	tests := []struct {
+		spec    string
+		want    FillStrategy
+		wantErr bool
+	}{
+		{spec: "", want: downFill{}},
+		{spec: "down", want: downFill{}},
+		{spec: "none", want: noneFill{}},
+		{spec: "up", want: upFill{}},
+		{spec: "constant:N/A", want: constantFill{value: "N/A"}},
+		{spec: "column-default:0=N/A,2=0", want: columnDefaultFill{defaults: map[int]string{0: "N/A", 2: "0"}}},
+		{spec: "bogus", wantErr: true},
+		{spec: "column-default:nope", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.spec, func(t *testing.T) {
+			got, err := newFillStrategy(tt.spec, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("newFillStrategy(%q) = nil error, want one", tt.spec)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newFillStrategy(%q) unexpected error: %v", tt.spec, err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("newFillStrategy(%q) = %#v, want %#v", tt.spec, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilterEmptyRows(t *testing.T) {
+	in := [][]string{{"", ""}, {"a", ""}, {"", ""}}
+	want := [][]string{{"a", ""}}
+	got := filterEmptyRows(in)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("filterEmptyRows() = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern string
+		target  string
+		want    bool
+	}{
+		{pattern: "*.xlsx", target: "sales.xlsx", want: true},
+		{pattern: "*.xlsx", target: "sales.csv", want: false},
+		{pattern: "sales_*.xlsx", target: "sales_q1.xlsx", want: true},
+		{pattern: "*", target: "2024/us/sales.xlsx", want: false}, // * doesn't cross "/"
+		{pattern: "**/archive/**", target: "2024/archive/sales.xlsx", want: true},
+		{pattern: "**/archive/**", target: "2024/us/sales.xlsx", want: false},
+		{pattern: "2024/**/*.xlsx", target: "2024/us/region/sales.xlsx", want: true},
+		{pattern: "2024/**/*.xlsx", target: "2025/us/sales.xlsx", want: false},
+		{pattern: "~$*", target: "~$sales.xlsx", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.pattern+" vs "+tt.target, func(t *testing.T) {
+			if got := matchGlob(tt.pattern, tt.target); got != tt.want {
+				t.Errorf("matchGlob(%q, %q) = %v, want %v", tt.pattern, tt.target, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchAnyGlobIsCaseInsensitive(t *testing.T) {
+	tests := []struct {
+		name     string
+		patterns []string
+		relPath  string
+		base     string
+		want     bool
+	}{
+		{
+			name:     "basename pattern ignores case",
+			patterns: []string{"*.xlsx"},
+			relPath:  "US/Sales.xlsx",
+			base:     "sales.xlsx", // listFiles already lowercases base
+			want:     true,
+		},
+		{
+			name:     "directory-component pattern ignores case",
+			patterns: []string{"us/*.xlsx"},
+			relPath:  "US/Sales.xlsx",
+			base:     "sales.xlsx",
+			want:     true,
+		},
+		{
+			name:     "directory-component pattern still rejects a non-match",
+			patterns: []string{"eu/*.xlsx"},
+			relPath:  "US/Sales.xlsx",
+			base:     "sales.xlsx",
+			want:     false,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := matchAnyGlob(tt.patterns, tt.relPath, tt.base); got != tt.want {
+				t.Errorf("matchAnyGlob(%v, %q, %q) = %v, want %v", tt.patterns, tt.relPath, tt.base, got, tt.want)
+			}
+		})
+	}
+}
@@ -3,12 +3,20 @@ package main
 import (
 	"bytes"
 	"encoding/csv"
+	"encoding/json"
 	"flag"
-	"io/ioutil"
+	"fmt"
+	"io"
 	"log"
+	"mime/multipart"
+	"net/http"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"text/template"
 
 	"github.com/360EntSecGroup-Skylar/excelize"
@@ -21,12 +29,27 @@ const ()
 var (
 	fileDir    = flag.String("dir", ".", "the directory of *.xlsx files you want to process")
 	outputName = flag.String("output", "./output.xlsx", "file to output the results to")
-	sheetName  = flag.String("sheet", "", "sheet name to pull data from")
+	sheetName  = flag.String("sheet", "*", "sheet name to pull data from. Accepts a literal name, a glob (Data*), a regex (re:^Q[1-4]$), or * for all sheets")
 	rowStart   = flag.Int("rowStart", 0, "row data starts on, to account for headers")
 	rowCount   = flag.Int("rowCount", 0, "number of rows to take, 0 for no limit")
 
+	recursive = flag.Bool("recursive", false, "recurse into subdirectories of -dir")
+	includes  globList
+	excludes  globList
+
 	newColumns = flag.String("columns", "{{.FileName}}", "new columns to prepend, comma-seperated with template syntax")
 
+	table         = flag.String("table", "", "table name to use for -output files ending in .sql")
+	columnsHeader = flag.Bool("columns-header", false, "for sql output, use the header row as the column list in each INSERT statement")
+
+	workers = flag.Int("workers", 1, "number of files to read concurrently. Rows are still written by a single goroutine, but files are no longer guaranteed to be read (and thus written) in listing order when this is >1")
+
+	fill          = flag.String("fill", "down", "blank cell fill strategy: none, down (default, inherit from the row above), up (inherit from the row below), constant:<value>, or column-default:<colIdx>=<value>,...")
+	fillColumns   = flag.String("fill-columns", "", "restrict -fill to these columns, as spreadsheet letters (A,C,E). Empty applies it to every column")
+	skipEmptyRows = flag.Bool("skip-empty-rows", false, "drop rows where every cell is blank, before templating")
+
+	serveAddr = flag.String("serve", "", "address to serve the collate API on (e.g. :8080) instead of running once with the above flags as defaults")
+
 	logV = flag.Bool("v", false, "enable verbose logging. Like no really, super verbose")
 
 	logConfig = zap.Config{
@@ -54,6 +77,222 @@ var (
 	}
 )
 
+func init() {
+	flag.Var(&includes, "include", "glob to include, repeatable (*.xlsx, sales_*.xlsx). Defaults to *.xlsx when unset")
+	flag.Var(&excludes, "exclude", "glob to exclude, repeatable (~$*, **/archive/**)")
+}
+
+// globList is a repeatable glob flag: -include *.xlsx -include sales_*.xlsx
+type globList []string
+
+func (g *globList) String() string { return strings.Join(*g, ",") }
+func (g *globList) Set(v string) error {
+	*g = append(*g, v)
+	return nil
+}
+
+// FillStrategy decides how blank cells in a sheet's rows get filled in
+// before templating. Apply is free to mutate rows in place and returns
+// the result, so strategies that also drop rows (see -skip-empty-rows)
+// compose with it naturally.
+type FillStrategy interface {
+	Apply(rows [][]string) [][]string
+}
+
+// columnFilter restricts a FillStrategy to a subset of columns. An empty
+// columns set means "every column".
+type columnFilter struct {
+	columns map[int]bool
+}
+
+func (c columnFilter) applies(ci int) bool {
+	if len(c.columns) == 0 {
+		return true
+	}
+	return c.columns[ci]
+}
+
+// noneFill leaves blanks untouched.
+type noneFill struct{}
+
+func (noneFill) Apply(rows [][]string) [][]string { return rows }
+
+// downFill inherits a blank cell's value from the same column of the row
+// above it, the original hardcoded behavior from before -fill existed.
+type downFill struct {
+	columnFilter
+}
+
+func (f downFill) Apply(rows [][]string) [][]string {
+	for ri := 1; ri < len(rows); ri++ {
+		row := rows[ri]
+		prev := rows[ri-1]
+		for ci, cell := range row {
+			if cell == "" && f.applies(ci) && ci < len(prev) {
+				row[ci] = prev[ci]
+			}
+		}
+	}
+	return rows
+}
+
+// fullSheetFiller is implemented by fill strategies that need to see the
+// whole sheet (not just the row above) to know what to fill a blank
+// with. streamSheet only pays for buffering a sheet in full when the
+// selected strategy actually requires it.
+type fullSheetFiller interface {
+	FillStrategy
+	needsFullSheet()
+}
+
+// upFill inherits a blank cell's value from the next non-blank row below
+// it, which means it needs the rest of the sheet rather than just the
+// row above.
+type upFill struct {
+	columnFilter
+}
+
+func (upFill) needsFullSheet() {}
+
+func (f upFill) Apply(rows [][]string) [][]string {
+	for ri := len(rows) - 2; ri >= 0; ri-- {
+		row := rows[ri]
+		next := rows[ri+1]
+		for ci, cell := range row {
+			if cell == "" && f.applies(ci) && ci < len(next) {
+				row[ci] = next[ci]
+			}
+		}
+	}
+	return rows
+}
+
+// constantFill fills every blank cell with a fixed value.
+type constantFill struct {
+	columnFilter
+	value string
+}
+
+func (f constantFill) Apply(rows [][]string) [][]string {
+	for _, row := range rows {
+		for ci, cell := range row {
+			if cell == "" && f.applies(ci) {
+				row[ci] = f.value
+			}
+		}
+	}
+	return rows
+}
+
+// columnDefaultFill fills blanks with a per-column default, e.g.
+// "0=N/A,2=0". -fill-columns doesn't apply here: the column list is
+// already explicit in the spec.
+type columnDefaultFill struct {
+	defaults map[int]string
+}
+
+func (f columnDefaultFill) Apply(rows [][]string) [][]string {
+	for _, row := range rows {
+		for ci, def := range f.defaults {
+			if ci < len(row) && row[ci] == "" {
+				row[ci] = def
+			}
+		}
+	}
+	return rows
+}
+
+// newFillStrategy parses the -fill flag into a FillStrategy, restricted
+// to columns (nil/empty meaning every column) where the mode supports it.
+func newFillStrategy(spec string, columns map[int]bool) (FillStrategy, error) {
+	filter := columnFilter{columns: columns}
+	switch {
+	case spec == "" || spec == "down":
+		return downFill{columnFilter: filter}, nil
+	case spec == "none":
+		return noneFill{}, nil
+	case spec == "up":
+		return upFill{columnFilter: filter}, nil
+	case strings.HasPrefix(spec, "constant:"):
+		return constantFill{columnFilter: filter, value: strings.TrimPrefix(spec, "constant:")}, nil
+	case strings.HasPrefix(spec, "column-default:"):
+		defaults, err := parseColumnDefaults(strings.TrimPrefix(spec, "column-default:"))
+		if err != nil {
+			return nil, err
+		}
+		return columnDefaultFill{defaults: defaults}, nil
+	default:
+		return nil, fmt.Errorf("unknown -fill mode %q", spec)
+	}
+}
+
+// parseColumnDefaults parses "0=N/A,2=0" into {0: "N/A", 2: "0"}.
+func parseColumnDefaults(spec string) (map[int]string, error) {
+	defaults := map[int]string{}
+	if spec == "" {
+		return defaults, nil
+	}
+	for _, pair := range strings.Split(spec, ",") {
+		idx, value, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid column-default entry %q, want <colIdx>=<value>", pair)
+		}
+		ci, err := strconv.Atoi(idx)
+		if err != nil {
+			return nil, fmt.Errorf("invalid column-default entry %q: %w", pair, err)
+		}
+		defaults[ci] = value
+	}
+	return defaults, nil
+}
+
+// columnLettersPattern matches a bare spreadsheet column reference (A,
+// C, AA, ...), which is all excelize.TitleToNumber accepts as input.
+var columnLettersPattern = regexp.MustCompile(`^[A-Za-z]+$`)
+
+// parseFillColumns parses a comma-separated list of spreadsheet column
+// letters ("A,C,E") into their 0-based indices.
+func parseFillColumns(spec string) (map[int]bool, error) {
+	if spec == "" {
+		return nil, nil
+	}
+	columns := map[int]bool{}
+	for _, letters := range strings.Split(spec, ",") {
+		letters = strings.TrimSpace(letters)
+		if !columnLettersPattern.MatchString(letters) {
+			return nil, fmt.Errorf("invalid -fill-columns entry %q: want spreadsheet column letters, e.g. A, C, AA", letters)
+		}
+		columns[excelize.TitleToNumber(letters)] = true
+	}
+	return columns, nil
+}
+
+// filterEmptyRows drops rows where every cell is blank.
+func filterEmptyRows(rows [][]string) [][]string {
+	kept := rows[:0]
+	for _, row := range rows {
+		if !rowIsEmpty(row) {
+			kept = append(kept, row)
+		}
+	}
+	return kept
+}
+
+func rowIsEmpty(row []string) bool {
+	for _, cell := range row {
+		if cell != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// templateFuncs are available to every -columns template, e.g.
+// {{index (split .DirName "/") 2}} to pull a path segment out of DirName.
+var templateFuncs = template.FuncMap{
+	"split": strings.Split,
+}
+
 func getColumns(columnString string) ([]*template.Template, error) {
 	r := csv.NewReader(bytes.NewBufferString(columnString))
 	columns, err := r.Read()
@@ -62,7 +301,7 @@ func getColumns(columnString string) ([]*template.Template, error) {
 	}
 	templates := make([]*template.Template, len(columns))
 	for i := range templates {
-		templates[i], err = template.New(strconv.Itoa(i)).Parse(columns[i])
+		templates[i], err = template.New(strconv.Itoa(i)).Funcs(templateFuncs).Parse(columns[i])
 		if err != nil {
 			return []*template.Template{}, err
 		}
@@ -71,9 +310,217 @@ func getColumns(columnString string) ([]*template.Template, error) {
 }
 
 type ColumnData struct {
-	Cells    []string
+	Cells     []string
+	FileName  string
+	RelPath   string
+	DirName   string
+	SheetName string
+	RowNum    int
+}
+
+// RawRow is a single row of source cells flowing through the read/write
+// pipeline, tagged with where it came from. It's the unit of work passed
+// down the row channel so the writer side never needs a whole sheet (or
+// file) in memory at once.
+type RawRow struct {
 	FileName string
+	RelPath  string
+	DirName  string
+	Sheet    string
 	RowNum   int
+	Cells    []string
+}
+
+// OutputWriter is implemented by every non-xlsx output format colate
+// supports. Header is written once before any rows, and columns is free
+// to use it (sql, json) or ignore it (csv, tsv).
+type OutputWriter interface {
+	WriteHeader(columns []string) error
+	WriteRow(row []string) error
+	Close() error
+}
+
+// newOutputWriter picks an OutputWriter for format ("csv", "tsv", "json"
+// or "sql") and writes to dest. xlsx output isn't handled here: it keeps
+// its own sheet-aware path through consumeXLSX, since OutputWriter has
+// no notion of sheets.
+func newOutputWriter(dest io.Writer, format, table string, columnsHeader bool) (OutputWriter, error) {
+	switch format {
+	case "csv":
+		return newDelimitedWriter(dest, ','), nil
+	case "tsv":
+		return newDelimitedWriter(dest, '\t'), nil
+	case "json":
+		return newJSONWriter(dest), nil
+	case "sql":
+		if table == "" {
+			return nil, fmt.Errorf("table name required for sql output, set with -table")
+		}
+		return newSQLWriter(dest, table, columnsHeader), nil
+	default:
+		return nil, fmt.Errorf("unsupported output format %q", format)
+	}
+}
+
+type delimitedWriter struct {
+	w *csv.Writer
+}
+
+func newDelimitedWriter(dest io.Writer, comma rune) *delimitedWriter {
+	w := csv.NewWriter(dest)
+	w.Comma = comma
+	return &delimitedWriter{w: w}
+}
+
+func (d *delimitedWriter) WriteHeader(columns []string) error { return d.w.Write(columns) }
+func (d *delimitedWriter) WriteRow(row []string) error        { return d.w.Write(row) }
+
+func (d *delimitedWriter) Close() error {
+	d.w.Flush()
+	return d.w.Error()
+}
+
+// jsonWriter emits an array of objects, keyed by the header passed to
+// WriteHeader, preserving column order (encoding a map directly would
+// alphabetize the keys).
+type jsonWriter struct {
+	dest   io.Writer
+	header []string
+	wrote  bool
+}
+
+func newJSONWriter(dest io.Writer) *jsonWriter {
+	return &jsonWriter{dest: dest}
+}
+
+func (j *jsonWriter) WriteHeader(columns []string) error {
+	j.header = columns
+	return nil
+}
+
+func (j *jsonWriter) WriteRow(row []string) error {
+	if !j.wrote {
+		if _, err := io.WriteString(j.dest, "[\n"); err != nil {
+			return err
+		}
+		j.wrote = true
+	} else {
+		if _, err := io.WriteString(j.dest, ",\n"); err != nil {
+			return err
+		}
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("  {")
+	for i, value := range row {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		key := fmt.Sprintf("col%d", i+1)
+		if i < len(j.header) {
+			key = j.header[i]
+		}
+		keyJSON, err := json.Marshal(key)
+		if err != nil {
+			return err
+		}
+		valueJSON, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		buf.Write(keyJSON)
+		buf.WriteString(":")
+		buf.Write(valueJSON)
+	}
+	buf.WriteString("}")
+
+	_, err := j.dest.Write(buf.Bytes())
+	return err
+}
+
+func (j *jsonWriter) Close() error {
+	if !j.wrote {
+		if _, err := io.WriteString(j.dest, "[\n"); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(j.dest, "\n]\n")
+	return err
+}
+
+// sqlWriter emits one INSERT INTO statement per row. If columnsHeader is
+// set, the header passed to WriteHeader becomes the column list;
+// otherwise each INSERT omits the column list entirely.
+type sqlWriter struct {
+	dest          io.Writer
+	table         string
+	columnsHeader bool
+	header        []string
+}
+
+func newSQLWriter(dest io.Writer, table string, columnsHeader bool) *sqlWriter {
+	return &sqlWriter{dest: dest, table: table, columnsHeader: columnsHeader}
+}
+
+func (s *sqlWriter) WriteHeader(columns []string) error {
+	s.header = columns
+	return nil
+}
+
+func (s *sqlWriter) WriteRow(row []string) error {
+	values := make([]string, len(row))
+	for i, v := range row {
+		values[i] = sqlQuote(v)
+	}
+
+	columnList := ""
+	if s.columnsHeader && len(s.header) > 0 {
+		columns := make([]string, len(s.header))
+		for i, c := range s.header {
+			columns[i] = `"` + strings.ReplaceAll(c, `"`, `""`) + `"`
+		}
+		columnList = "(" + strings.Join(columns, ", ") + ")"
+	}
+
+	_, err := fmt.Fprintf(s.dest, "INSERT INTO %s%s VALUES(%s);\n", s.table, columnList, strings.Join(values, ", "))
+	return err
+}
+
+func (s *sqlWriter) Close() error { return nil }
+
+func sqlQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// sqlIdentifierPattern constrains -table / ?table=, which gets
+// interpolated unquoted into "INSERT INTO %s". The CLI flag used to be
+// operator-controlled, but the HTTP API now lets a request supply it
+// too, so it's validated as a plain identifier rather than trusted.
+var sqlIdentifierPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.]*$`)
+
+// CollateOptions is everything a collation run needs, whether it's
+// coming from the CLI flags or an HTTP request.
+type CollateOptions struct {
+	Dir       string
+	Recursive bool
+	Includes  []string
+	Excludes  []string
+
+	Sheet    string
+	RowStart int
+	RowCount int
+
+	Columns []*template.Template
+
+	Workers int
+
+	Format        string
+	Table         string
+	ColumnsHeader bool
+
+	Fill          string
+	FillColumns   string
+	SkipEmptyRows bool
 }
 
 func main() {
@@ -104,156 +551,731 @@ func main() {
 		)
 	}
 
-	files, err := listFiles(*fileDir)
+	opts := CollateOptions{
+		Dir:           *fileDir,
+		Recursive:     *recursive,
+		Includes:      includes,
+		Excludes:      excludes,
+		Sheet:         *sheetName,
+		RowStart:      *rowStart,
+		RowCount:      *rowCount,
+		Columns:       columns,
+		Workers:       *workers,
+		Format:        formatFromExt(*outputName),
+		Table:         *table,
+		ColumnsHeader: *columnsHeader,
+		Fill:          *fill,
+		FillColumns:   *fillColumns,
+		SkipEmptyRows: *skipEmptyRows,
+	}
 
-	l.Debugw("files",
-		"files", files,
-	)
+	if *serveAddr != "" {
+		l.Infow("starting collate API server", "addr", *serveAddr)
+		if err := runServer(l, *serveAddr, opts); err != nil {
+			l.Fatalw("fatal error",
+				"error", err,
+			)
+		}
+		return
+	}
 
+	out, err := os.Create(*outputName)
 	if err != nil {
 		l.Fatalw("fatal error",
 			"error", err,
 		)
 	}
+	defer out.Close()
 
-	var data [][]string
-	for _, file := range files {
-		l := l.With(
-			"file", file,
+	if err := runCollate(l, opts, out); err != nil {
+		l.Fatalw("fatal error",
+			"error", err,
 		)
-		l.Debug("starting file")
+	}
+}
 
-		fileBase := filepath.Base(file)
-		thisData, err := getRows(l, file, *sheetName, *rowStart, *rowCount)
+func formatFromExt(path string) string {
+	return strings.TrimPrefix(strings.ToLower(filepath.Ext(path)), ".")
+}
+
+// runCollate lists opts.Dir, streams every matched file's rows through a
+// bounded channel (read concurrency bounded by opts.Workers), and writes
+// the collated result to dest in opts.Format.
+func runCollate(l *zap.SugaredLogger, opts CollateOptions, dest io.Writer) error {
+	files, err := listFiles(opts.Dir, opts.Recursive, opts.Includes, opts.Excludes)
+	if err != nil {
+		return err
+	}
+	l.Debugw("files",
+		"files", files,
+	)
+
+	fillColumnSet, err := parseFillColumns(opts.FillColumns)
+	if err != nil {
+		return err
+	}
+	fillStrategy, err := newFillStrategy(opts.Fill, fillColumnSet)
+	if err != nil {
+		return err
+	}
+
+	workerCount := opts.Workers
+	if workerCount < 1 {
+		workerCount = 1
+	}
+	rows := make(chan RawRow, workerCount*4)
+	readErrs := make(chan error, len(files))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, workerCount)
+	for _, file := range files {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(file string) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			l := l.With("file", file)
+			l.Debug("starting file")
+			if err := streamFile(l, opts.Dir, file, opts.Sheet, opts.RowStart, opts.RowCount, fillStrategy, opts.SkipEmptyRows, rows); err != nil {
+				readErrs <- err
+			}
+		}(file)
+	}
+	go func() {
+		wg.Wait()
+		close(rows)
+		close(readErrs)
+	}()
+
+	if opts.Format == "xlsx" {
+		f, err := consumeXLSX(l, rows, opts.Columns)
 		if err != nil {
-			l.Fatalw("fatal error",
-				"error", err,
-			)
+			return err
 		}
-
-		// prepend the file name
-		columnData := ColumnData{
-			FileName: fileBase,
+		if err := f.Write(dest); err != nil {
+			return err
 		}
-		thisData = prependColumns(l, thisData, columnData, columns)
+	} else {
+		if err := consumeFlat(l, rows, opts.Columns, dest, opts.Format, opts.Table, opts.ColumnsHeader); err != nil {
+			return err
+		}
+	}
 
-		// add to output data
-		data = append(data, thisData...)
+	for err := range readErrs {
+		return err
 	}
+	return nil
+}
 
-	// save data to new file
-	output := createFile(l, *sheetName, data)
-	// write out!
-	err = output.SaveAs(*outputName)
+// streamFile opens file and pushes every matched sheet's rows onto out.
+// baseDir is used to compute RelPath/DirName relative to the scanned
+// directory.
+func streamFile(l *zap.SugaredLogger, baseDir, file, sheetPattern string, start, count int, fill FillStrategy, skipEmptyRows bool, out chan<- RawRow) error {
+	f, err := excelize.OpenFile(file)
 	if err != nil {
-		l.Fatalw("fatal error",
-			"error", err,
-		)
+		return err
+	}
+
+	sheetNames, err := resolveSheets(f, sheetPattern)
+	if err != nil {
+		return err
+	}
+
+	fileBase := filepath.Base(file)
+	relPath := fileBase
+	dirName := "."
+	if rel, err := filepath.Rel(baseDir, file); err == nil {
+		relPath = filepath.ToSlash(rel)
+		dirName = filepath.ToSlash(filepath.Dir(rel))
+	}
+
+	for _, sheet := range sheetNames {
+		if err := streamSheet(l.With("sheet", sheet), f, fileBase, relPath, dirName, sheet, start, count, fill, skipEmptyRows, out); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// streamSheet reads sheet's rows and pushes the filled result onto out.
+// Most fill strategies (none, down, constant, column-default) only ever
+// look at the row above, so they stay on streamSheetRowByRow, the
+// bounded-memory path from chunk0-3 that buffers just the previous row.
+// Only a strategy that actually needs the rest of the sheet (upFill) pays
+// for streamSheetBuffered, which reads the whole sheet into memory first.
+func streamSheet(l *zap.SugaredLogger, f *excelize.File, fileBase, relPath, dirName, sheet string, start, count int, fill FillStrategy, skipEmptyRows bool, out chan<- RawRow) error {
+	if _, full := fill.(fullSheetFiller); full {
+		return streamSheetBuffered(f, fileBase, relPath, dirName, sheet, start, count, fill, skipEmptyRows, out)
 	}
+	return streamSheetRowByRow(l, f, fileBase, relPath, dirName, sheet, start, count, fill, skipEmptyRows, out)
 }
 
-func listFiles(dir string) ([]string, error) {
-	files, err := ioutil.ReadDir(dir)
+// streamSheetRowByRow never holds more than the current and previous
+// (already-filled) row of a sheet in memory. excelize's Rows iterator
+// surfaces read errors via Error() once iteration stops, not per-call,
+// so that's checked after the loop rather than on every Next().
+func streamSheetRowByRow(l *zap.SugaredLogger, f *excelize.File, fileBase, relPath, dirName, sheet string, start, count int, fill FillStrategy, skipEmptyRows bool, out chan<- RawRow) error {
+	iter, err := f.Rows(sheet)
 	if err != nil {
-		return []string{}, err
+		return err
 	}
 
-	var ret []string
-	for _, file := range files {
-		if ok, _ := filepath.Match("*.xlsx", strings.ToLower(file.Name())); ok {
-			ret = append(ret, filepath.Join(dir, file.Name()))
+	var prev []string
+	rawRow := -1
+	outRow := 0
+	thisCount := count
+	for iter.Next() {
+		rawRow++
+		row := iter.Columns()
+		if rawRow < start {
+			continue
+		}
+
+		window := make([][]string, 0, 2)
+		if prev != nil {
+			window = append(window, prev)
+		}
+		window = append(window, row)
+		window = fill.Apply(window)
+		row = window[len(window)-1]
+		prev = row
+
+		if skipEmptyRows && rowIsEmpty(row) {
+			continue
+		}
+
+		out <- RawRow{FileName: fileBase, RelPath: relPath, DirName: dirName, Sheet: sheet, RowNum: outRow, Cells: row}
+		outRow++
+
+		if count > 0 {
+			thisCount--
+			if thisCount == 0 {
+				break
+			}
 		}
 	}
-	return ret, nil
+	return iter.Error()
 }
 
-func createFile(l *zap.SugaredLogger, name string, data [][]string) *excelize.File {
-	f := excelize.NewFile()
-	sheetIndex := f.NewSheet(name)
-	f.SetActiveSheet(sheetIndex)
-	writeData(l, f, 0, name, data)
-	return f
-}
-
-func writeData(l *zap.SugaredLogger, f *excelize.File, startRow int, sheet string, data [][]string) int {
-	l.Debugw("writeData()",
-		"f", "<omitted>",
-		"startRow", startRow,
-		"sheet", sheet,
-		"data", len(data),
-	)
-	for ri, row := range data {
-		for ci, value := range row {
-			// construct cell name. Note: excel is 1 indexed
-			loc := excelize.ToAlphaString(ci) + strconv.Itoa(startRow+ri+1)
-			f.SetCellStr(sheet, loc, value)
+// streamSheetBuffered reads sheet in full before filling, for strategies
+// like upFill that need to see rows below the current one to know what
+// to fill a blank with.
+func streamSheetBuffered(f *excelize.File, fileBase, relPath, dirName, sheet string, start, count int, fill FillStrategy, skipEmptyRows bool, out chan<- RawRow) error {
+	iter, err := f.Rows(sheet)
+	if err != nil {
+		return err
+	}
+
+	var rows [][]string
+	rawRow := -1
+	for iter.Next() {
+		rawRow++
+		row := iter.Columns()
+		if rawRow < start {
+			continue
 		}
+		rows = append(rows, row)
+	}
+	if err := iter.Error(); err != nil {
+		return err
+	}
+
+	rows = fill.Apply(rows)
+	if skipEmptyRows {
+		rows = filterEmptyRows(rows)
+	}
+	if count > 0 && count < len(rows) {
+		rows = rows[:count]
 	}
 
-	return startRow + len(data)
+	for outRow, row := range rows {
+		out <- RawRow{FileName: fileBase, RelPath: relPath, DirName: dirName, Sheet: sheet, RowNum: outRow, Cells: row}
+	}
+	return nil
 }
 
-// prependColumns will take a two dimensional slice of strings and insert a new
-// column. The values for the new column are taken from "source", the input
-// slice is repeated as many times as necessary to fill all rows of the input
-func prependColumns(l *zap.SugaredLogger, rows [][]string, columnData ColumnData, sources []*template.Template) [][]string {
-	l.Debugw("insertColumn()",
-		"rows", len(rows),
+// applyColumns prepends the configured template columns to a single row,
+// the streaming equivalent of the old batch prependColumns.
+func applyColumns(l *zap.SugaredLogger, columnData ColumnData, sources []*template.Template) []string {
+	l.Debugw("applyColumns()",
 		"columnData", columnData,
 	)
-	for ri, row := range rows {
-		columnData.Cells = row
-		columnData.RowNum = ri
-		newData := make([]string, len(sources))
-		for si, source := range sources {
-			toPut := new(bytes.Buffer)
-			// get the value to put
-			err := source.Execute(toPut, columnData)
-			if err != nil {
-				l.Warnw("error executing column template",
-					"err", err,
-					"template", source.DefinedTemplates(),
-					"columnData", columnData,
-				)
+	newData := make([]string, len(sources))
+	for si, source := range sources {
+		toPut := new(bytes.Buffer)
+		err := source.Execute(toPut, columnData)
+		if err != nil {
+			l.Warnw("error executing column template",
+				"err", err,
+				"template", source.DefinedTemplates(),
+				"columnData", columnData,
+			)
+		}
+		newData[si] = toPut.String()
+	}
+	return append(newData, columnData.Cells...)
+}
+
+// consumeXLSX drains rows into one sheet per source sheet, via
+// SetSheetRow (this excelize version has no StreamWriter). The caller
+// writes the returned workbook wherever it needs to (a file, an HTTP
+// response).
+func consumeXLSX(l *zap.SugaredLogger, rows <-chan RawRow, columns []*template.Template) (_ *excelize.File, err error) {
+	// An early return below (a bad sheet name, a write error) would
+	// otherwise leave the producer goroutines in runCollate blocked
+	// forever on a full rows channel. Drain whatever's left so they can
+	// finish and the channel gets closed.
+	defer func() {
+		if err != nil {
+			drainRows(rows)
+		}
+	}()
+
+	f := excelize.NewFile()
+	seen := map[string]bool{}
+	rowCounts := make(map[string]int)
+	var sheetOrder []string
+
+	for raw := range rows {
+		if !seen[raw.Sheet] {
+			idx := f.NewSheet(raw.Sheet)
+			if len(sheetOrder) == 0 {
+				f.SetActiveSheet(idx)
 			}
-			newData[si] = toPut.String()
+			sheetOrder = append(sheetOrder, raw.Sheet)
+			seen[raw.Sheet] = true
 		}
 
-		// reconstruct the new slice, replacing the current row
-		rows[ri] = append(newData, row...)
+		columnData := ColumnData{FileName: raw.FileName, RelPath: raw.RelPath, DirName: raw.DirName, SheetName: raw.Sheet, RowNum: raw.RowNum, Cells: raw.Cells}
+		row := applyColumns(l, columnData, columns)
+
+		rowCounts[raw.Sheet]++
+		cell := "A" + strconv.Itoa(rowCounts[raw.Sheet])
+		cellValues := toCellValues(row)
+		f.SetSheetRow(raw.Sheet, cell, &cellValues)
 	}
-	return rows
+
+	if len(sheetOrder) > 0 && !seen["Sheet1"] {
+		f.DeleteSheet("Sheet1")
+	}
+	return f, nil
 }
 
-func getRows(l *zap.SugaredLogger, file, sheet string, start, count int) ([][]string, error) {
-	f, err := excelize.OpenFile(file)
+// drainRows discards whatever's left on rows. Used after an early return
+// from a consumer so the producer goroutines feeding it (blocked on a
+// full channel send) can finish instead of leaking.
+func drainRows(rows <-chan RawRow) {
+	for range rows {
+	}
+}
+
+// consumeFlat drains rows straight into the OutputWriter matching
+// format, writing a best-effort header on the first row.
+func consumeFlat(l *zap.SugaredLogger, rows <-chan RawRow, columns []*template.Template, dest io.Writer, format, table string, columnsHeader bool) (err error) {
+	// Same reasoning as consumeXLSX: an early return (a client
+	// disconnecting mid-download is the common one, via writer.WriteRow)
+	// must not leave the producer goroutines in runCollate blocked
+	// forever on a full rows channel.
+	defer func() {
+		if err != nil {
+			drainRows(rows)
+		}
+	}()
+
+	writer, err := newOutputWriter(dest, format, table, columnsHeader)
 	if err != nil {
-		return [][]string{}, err
+		return err
 	}
 
-	rows := f.GetRows(sheet)
+	headerWritten := false
+	for raw := range rows {
+		columnData := ColumnData{FileName: raw.FileName, RelPath: raw.RelPath, DirName: raw.DirName, SheetName: raw.Sheet, RowNum: raw.RowNum, Cells: raw.Cells}
+		row := applyColumns(l, columnData, columns)
 
-	// start from intended position
-	rows = rows[start:]
+		if !headerWritten {
+			if err := writer.WriteHeader(columnHeader(columns, len(row))); err != nil {
+				return err
+			}
+			headerWritten = true
+		}
+		if err := writer.WriteRow(row); err != nil {
+			return err
+		}
+	}
+	if !headerWritten {
+		if err := writer.WriteHeader(columnHeader(columns, len(columns))); err != nil {
+			return err
+		}
+	}
+	return writer.Close()
+}
 
-	// fill in blanks with preceeding values
-	for ri, row := range rows {
-		for ci, cell := range row {
-			if cell == "" && ri != 0 {
-				l.Debugw("inheriting empty cell value from previous row",
-					"row", ri,
-					"column", ci,
-					"value", cell,
-					"inherited", rows[ri-1][ci],
-				)
-				row[ci] = rows[ri-1][ci]
+// columnHeader builds a best-effort header row for formats that want one
+// (sql column names, json object keys): the prepended column templates
+// by name, followed by generic labels for the remaining source cells.
+func columnHeader(columns []*template.Template, width int) []string {
+	header := make([]string, 0, width)
+	for _, c := range columns {
+		header = append(header, c.Name())
+	}
+	for i := len(header); i < width; i++ {
+		header = append(header, fmt.Sprintf("col%d", i+1))
+	}
+	return header
+}
+
+func toCellValues(row []string) []interface{} {
+	values := make([]interface{}, len(row))
+	for i, v := range row {
+		values[i] = v
+	}
+	return values
+}
+
+// resolveSheets expands a --sheet pattern into the concrete sheet names
+// present in f. The pattern may be a literal sheet name, a glob (Data*),
+// a regex prefixed with "re:" (re:^Q[1-4]$), or a bare "*" to match every
+// sheet. Sheets are returned in workbook order.
+func resolveSheets(f *excelize.File, pattern string) ([]string, error) {
+	sheetMap := f.GetSheetMap()
+
+	ids := make([]int, 0, len(sheetMap))
+	for id := range sheetMap {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	var match func(name string) (bool, error)
+	if strings.HasPrefix(pattern, "re:") {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, "re:"))
+		if err != nil {
+			return nil, err
+		}
+		match = func(name string) (bool, error) { return re.MatchString(name), nil }
+	} else {
+		match = func(name string) (bool, error) { return filepath.Match(pattern, name) }
+	}
+
+	var names []string
+	for _, id := range ids {
+		name := sheetMap[id]
+		ok, err := match(name)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// listFiles walks dir (recursing into subdirectories when recursive is
+// set) and returns every file matching one of includes (defaulting to
+// *.xlsx) and none of excludes. Patterns containing a "/" are matched
+// against the path relative to dir; patterns without one are matched
+// against the file's base name.
+func listFiles(dir string, recursive bool, includes, excludes []string) ([]string, error) {
+	if len(includes) == 0 {
+		includes = []string{"*.xlsx"}
+	}
+
+	var ret []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if !recursive && path != dir {
+				return filepath.SkipDir
 			}
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		base := strings.ToLower(filepath.Base(path))
+
+		if !matchAnyGlob(includes, rel, base) {
+			return nil
+		}
+		if matchAnyGlob(excludes, rel, base) {
+			return nil
+		}
+
+		ret = append(ret, path)
+		return nil
+	})
+	if err != nil {
+		return []string{}, err
+	}
+	return ret, nil
+}
+
+// matchAnyGlob reports whether any pattern matches. A pattern containing
+// "/" is matched against relPath; otherwise it's matched against base.
+// "**" in a pattern matches across directory separators.
+func matchAnyGlob(patterns []string, relPath, base string) bool {
+	for _, pattern := range patterns {
+		target := base
+		if strings.Contains(pattern, "/") {
+			target = strings.ToLower(relPath)
+		}
+		if matchGlob(strings.ToLower(pattern), target) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchGlob(pattern, target string) bool {
+	if !strings.Contains(pattern, "**") {
+		ok, _ := filepath.Match(pattern, target)
+		return ok
+	}
+
+	var re strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch {
+		case strings.HasPrefix(pattern[i:], "**"):
+			re.WriteString(".*")
+			i++
+		case pattern[i] == '*':
+			re.WriteString("[^/]*")
+		case strings.ContainsRune(`.+()|[]{}^$\`, rune(pattern[i])):
+			re.WriteString(`\` + string(pattern[i]))
+		default:
+			re.WriteByte(pattern[i])
+		}
+	}
+	re.WriteString("$")
+
+	ok, _ := regexp.MatchString(re.String(), target)
+	return ok
+}
+
+// runServer starts the collate HTTP API on addr. defaults supplies the
+// CLI-configured values (workers, table, columns-header, ...) for
+// anything a request doesn't override.
+func runServer(l *zap.SugaredLogger, addr string, defaults CollateOptions) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/collate", func(w http.ResponseWriter, r *http.Request) {
+		handleCollate(l, defaults, w, r)
+	})
+	return http.ListenAndServe(addr, mux)
+}
+
+func handleCollate(l *zap.SugaredLogger, defaults CollateOptions, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		handleCollateDir(l, defaults, w, r)
+	case http.MethodPost:
+		handleCollateUpload(l, defaults, w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// validRequestDir reports whether dir is safe to join onto defaults.Dir:
+// relative, and with no ".." component that could walk it back out.
+func validRequestDir(dir string) bool {
+	return !filepath.IsAbs(dir) && !strings.Contains(dir, "..")
+}
+
+// handleCollateDir serves GET /collate?dir=...&sheet=...&columns=...&format=csv,
+// collating files already on disk under defaults.Dir.
+func handleCollateDir(l *zap.SugaredLogger, defaults CollateOptions, w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	dir := query.Get("dir")
+	if dir == "" {
+		dir = "."
+	}
+	if !validRequestDir(dir) {
+		http.Error(w, "dir must be a relative path and must not contain \"..\"", http.StatusBadRequest)
+		return
+	}
+
+	opts := defaults
+	opts.Dir = filepath.Join(defaults.Dir, dir)
+
+	if err := applyRequestOverrides(&opts, query.Get("sheet"), query.Get("columns"), query.Get("format"), query.Get("table"), r.Header.Get("Accept")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	serveCollated(l, opts, w)
+}
+
+// handleCollateUpload serves POST /collate, a multipart upload of xlsx
+// files under the "files" field, collated the same way as the CLI.
+func handleCollateUpload(l *zap.SugaredLogger, defaults CollateOptions, w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tmpDir, err := os.MkdirTemp("", "colate-upload-")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(tmpDir)
+
+	uploads := r.MultipartForm.File["files"]
+	if len(uploads) == 0 {
+		http.Error(w, "no files uploaded under the \"files\" field", http.StatusBadRequest)
+		return
+	}
+	for _, fh := range uploads {
+		if err := saveUpload(tmpDir, fh); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	opts := defaults
+	opts.Dir = tmpDir
+	opts.Recursive = false
+
+	if err := applyRequestOverrides(&opts, r.FormValue("sheet"), r.FormValue("columns"), r.FormValue("format"), r.FormValue("table"), r.Header.Get("Accept")); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	serveCollated(l, opts, w)
+}
+
+func saveUpload(dir string, fh *multipart.FileHeader) error {
+	src, err := fh.Open()
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.Create(filepath.Join(dir, filepath.Base(fh.Filename)))
+	if err != nil {
+		return err
+	}
+	defer dst.Close()
+
+	_, err = io.Copy(dst, src)
+	return err
+}
+
+// applyRequestOverrides layers request parameters onto opts: sheet and
+// table replace the CLI defaults when non-empty, columns is re-parsed as
+// a template list, and format falls back to the Accept header and then
+// to the CLI's -output extension.
+func applyRequestOverrides(opts *CollateOptions, sheet, columns, format, table, accept string) error {
+	if sheet != "" {
+		opts.Sheet = sheet
+	}
+	if table != "" {
+		if !sqlIdentifierPattern.MatchString(table) {
+			return fmt.Errorf("invalid table name %q: must match %s", table, sqlIdentifierPattern.String())
 		}
-		count = count - 1
-		if count == 0 {
-			break
+		opts.Table = table
+	}
+	if columns != "" {
+		parsed, err := getColumns(columns)
+		if err != nil {
+			return fmt.Errorf("couldn't parse columns parameter: %w", err)
 		}
+		opts.Columns = parsed
 	}
 
-	return rows, nil
+	if format == "" {
+		format = formatFromAccept(accept)
+	}
+	if format != "" {
+		opts.Format = format
+	}
+
+	switch opts.Format {
+	case "xlsx", "csv", "tsv", "json", "sql":
+	default:
+		return fmt.Errorf("unsupported format %q", opts.Format)
+	}
+	if opts.Format == "sql" && opts.Table == "" {
+		return fmt.Errorf("table name required for sql output, set -table or pass ?table=")
+	}
+	return nil
+}
+
+func formatFromAccept(accept string) string {
+	switch {
+	case strings.Contains(accept, "csv"):
+		return "csv"
+	case strings.Contains(accept, "tab-separated"):
+		return "tsv"
+	case strings.Contains(accept, "json"):
+		return "json"
+	case strings.Contains(accept, "sql"):
+		return "sql"
+	case strings.Contains(accept, "spreadsheetml"):
+		return "xlsx"
+	default:
+		return ""
+	}
+}
+
+func contentTypeForFormat(format string) string {
+	switch format {
+	case "xlsx":
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case "csv":
+		return "text/csv"
+	case "tsv":
+		return "text/tab-separated-values"
+	case "json":
+		return "application/json"
+	case "sql":
+		return "application/sql"
+	default:
+		return "application/octet-stream"
+	}
 }
+
+// serveCollated runs the collation and streams the result straight into
+// the response body -- nothing is written to disk on the server side.
+func serveCollated(l *zap.SugaredLogger, opts CollateOptions, w http.ResponseWriter) {
+	w.Header().Set("Content-Type", contentTypeForFormat(opts.Format))
+
+	tracked := &trackingWriter{w: w}
+	if err := runCollate(l, opts, tracked); err != nil {
+		l.Warnw("collate request failed",
+			"error", err,
+		)
+		if !tracked.wrote {
+			// nothing's hit the wire yet (e.g. the dir doesn't exist, or
+			// -table/-fill failed to parse), so a real status still helps
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// otherwise the body is already partially written and the status
+		// line is long gone; there's nothing more useful to do than log it
+	}
+}
+
+// trackingWriter records whether anything has been written yet, so
+// serveCollated can tell a failure that happened before the response
+// body started (worth an http.Error) from one mid-stream (too late for
+// a status code, only worth logging).
+type trackingWriter struct {
+	w     http.ResponseWriter
+	wrote bool
+}
+
+func (t *trackingWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		t.wrote = true
+	}
+	return t.w.Write(p)
+}
+
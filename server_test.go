@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+func TestValidRequestDir(t *testing.T) {
+	tests := []struct {
+		dir  string
+		want bool
+	}{
+		{dir: ".", want: true},
+		{dir: "2024/us", want: true},
+		{dir: "../etc", want: false},
+		{dir: "2024/../../etc", want: false},
+		{dir: "/etc/passwd", want: false},
+		{dir: "..", want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.dir, func(t *testing.T) {
+			if got := validRequestDir(tt.dir); got != tt.want {
+				t.Errorf("validRequestDir(%q) = %v, want %v", tt.dir, got, tt.want)
+			}
+		})
+	}
+}